@@ -0,0 +1,106 @@
+package mq
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations holds the ordered schema steps for the %s-prefixed queue tables; its index is the schema version recorded in %s_config.
+var migrations = []string{
+	// 0: baseline queue table
+	`
+CREATE SEQUENCE IF NOT EXISTS %sq_id_seq;
+CREATE TABLE IF NOT EXISTS %sq (
+	id INT8 NOT NULL DEFAULT nextval('%sq_id_seq') PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL DEFAULt now(),
+	checkout TIMESTAMP,
+	payload BYTEA
+);
+CREATE INDEX IF NOT EXISTS %sq_timestamp_idx ON %sq (checkout ASC NULLS FIRST, timestamp ASC);
+`,
+	// 1: dead-letter archive table and retry bookkeeping
+	`
+ALTER TABLE %sq ADD COLUMN IF NOT EXISTS read_ct INT NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS %sq_archive (
+	id INT8 NOT NULL PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL,
+	checkout TIMESTAMP,
+	read_ct INT NOT NULL DEFAULT 0,
+	payload BYTEA,
+	archived_at TIMESTAMP NOT NULL DEFAULT now()
+);
+`,
+	// 2: LISTEN/NOTIFY trigger for event-driven consumers
+	`
+CREATE OR REPLACE FUNCTION %sq_notify() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('%sq_new', NEW.id::text);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS %sq_notify_trigger ON %sq;
+CREATE TRIGGER %sq_notify_trigger AFTER INSERT ON %sq
+	FOR EACH ROW EXECUTE PROCEDURE %sq_notify();
+`,
+	// 3: scheduling, priority, and per-message headers
+	`
+ALTER TABLE %sq ADD COLUMN IF NOT EXISTS visible_at TIMESTAMP NOT NULL DEFAULT now();
+ALTER TABLE %sq ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE %sq ADD COLUMN IF NOT EXISTS headers JSONB;
+CREATE INDEX IF NOT EXISTS %sq_priority_idx ON %sq (priority DESC, visible_at ASC, timestamp ASC);
+`,
+}
+
+var createConfigSchema = `
+CREATE TABLE IF NOT EXISTS %s_config (
+	id SMALLINT PRIMARY KEY,
+	version INTEGER NOT NULL
+);
+`
+
+// pendingMigrations returns the migrations indices still to apply for a schema at version (-1 for none yet).
+func pendingMigrations(version int) []int {
+	pending := make([]int, 0, len(migrations))
+	for i := version + 1; i < len(migrations); i++ {
+		pending = append(pending, i)
+	}
+	return pending
+}
+
+// Migrate brings the schema up to date, applying each pending step in its own transaction.
+func (p *Pgmq) Migrate() error {
+	if _, err := p.DB.Exec(expandPrefix(createConfigSchema, p.Prefix)); err != nil {
+		return err
+	}
+
+	version := -1
+	row := p.DB.QueryRow(fmt.Sprintf("SELECT version FROM %s_config WHERE id = 0", p.Prefix))
+	switch err := row.Scan(&version); err {
+	case sql.ErrNoRows:
+		version = -1
+	case nil:
+	default:
+		return err
+	}
+
+	for _, i := range pendingMigrations(version) {
+		txn, err := p.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := txn.Exec(expandPrefix(migrations[i], p.Prefix)); err != nil {
+			txn.Rollback()
+			return err
+		}
+		upsert := fmt.Sprintf(`INSERT INTO %s_config (id, version) VALUES (0, $1)
+ON CONFLICT (id) DO UPDATE SET version = $1`, p.Prefix)
+		if _, err := txn.Exec(upsert, i); err != nil {
+			txn.Rollback()
+			return err
+		}
+		if err := txn.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPublisherClosed is returned by Enqueue once Close has been called.
+var ErrPublisherClosed = errors.New("mq: publisher closed")
+
+// pendingPublish pairs a queued message with the channel its caller awaits.
+type pendingPublish struct {
+	msg *Message
+	err chan error
+}
+
+// Publisher wraps a Pgmq and coalesces many small Enqueue calls into fewer, larger Publish batches.
+type Publisher struct {
+	p            *Pgmq
+	batchSize    int
+	flushTimeout time.Duration
+
+	pending chan pendingPublish
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewPublisher wraps p with a background flusher batching Enqueue calls by size and flushTimeout.
+func NewPublisher(p *Pgmq, batchSize int, flushTimeout time.Duration) *Publisher {
+	pub := &Publisher{
+		p:            p,
+		batchSize:    batchSize,
+		flushTimeout: flushTimeout,
+		pending:      make(chan pendingPublish),
+		done:         make(chan struct{}),
+	}
+	pub.wg.Add(1)
+	go pub.run()
+	return pub
+}
+
+// Enqueue queues msg and returns a channel receiving the eventual Publish error, or ErrPublisherClosed if Close has run.
+func (pub *Publisher) Enqueue(msg *Message) <-chan error {
+	errc := make(chan error, 1)
+	select {
+	case pub.pending <- pendingPublish{msg: msg, err: errc}:
+	case <-pub.done:
+		errc <- ErrPublisherClosed
+	}
+	return errc
+}
+
+// Close stops the background flusher, flushing any pending messages, and waits for it to exit.
+func (pub *Publisher) Close() {
+	close(pub.done)
+	pub.wg.Wait()
+}
+
+func (pub *Publisher) run() {
+	defer pub.wg.Done()
+
+	batch := make([]pendingPublish, 0, pub.batchSize)
+	timer := time.NewTimer(pub.flushTimeout)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		messages := make([]*Message, len(batch))
+		for i, b := range batch {
+			messages[i] = b.msg
+		}
+		// A batch aggregates messages from multiple Enqueue callers, so
+		// there is no single caller context to propagate here.
+		err := pub.p.Publish(context.Background(), messages)
+		for _, b := range batch {
+			b.err <- err
+			close(b.err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case b := <-pub.pending:
+			batch = append(batch, b)
+			if len(batch) >= pub.batchSize {
+				flush()
+				timer.Reset(pub.flushTimeout)
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(pub.flushTimeout)
+		case <-pub.done:
+			flush()
+			return
+		}
+	}
+}
@@ -1,32 +1,47 @@
 package mq
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pq "github.com/lib/pq" // Postgresql Driver
 )
 
-var createSchema = `
-CREATE SEQUENCE IF NOT EXISTS %sq_id_seq;
-CREATE TABLE IF NOT EXISTS %sq (
-	id INT8 NOT NULL DEFAULT nextval('%sq_id_seq') PRIMARY KEY,
-	timestamp TIMESTAMP NOT NULL DEFAULt now(),
-	checkout TIMESTAMP,
-	payload BYTEA
-);
-CREATE INDEX IF NOT EXISTS %sq_timestamp_idx ON %sq (checkout ASC NULLS FIRST, timestamp ASC);
-`
+// expandPrefix fills every %s verb in tmpl with prefix, without the caller
+// having to keep a hand count of placeholders in sync with the SQL.
+func expandPrefix(tmpl, prefix string) string {
+	args := make([]interface{}, strings.Count(tmpl, "%s"))
+	for i := range args {
+		args[i] = prefix
+	}
+	return fmt.Sprintf(tmpl, args...)
+}
+
 var dropScrema = `
+DROP TRIGGER IF EXISTS %sq_notify_trigger ON %sq;
+DROP FUNCTION IF EXISTS %sq_notify();
+DROP TABLE IF EXISTS %sq_archive;
 DROP TABLE IF EXISTS %sq;
 DROP SEQUENCE IF EXISTS %sq_id_seq;
+DROP TABLE IF EXISTS %s_config;
 `
 
 // Message ... Basic message
 type Message struct {
 	Payload []byte
+	// Delay postpones delivery until Delay has elapsed since Publish.
+	Delay time.Duration
+	// Priority controls which messages ConsumeBatch claims first: higher
+	// first. The order of messages inside one returned batch is not defined.
+	Priority int16
+	// Headers carries small amounts of caller-defined metadata.
+	Headers map[string]string
 }
 
 // ConsumerMessage ... Message for a consumer
@@ -41,29 +56,47 @@ type MessageRecipt struct {
 	Success bool
 }
 
+// splitRecipts separates recipts into ids to delete and failures for ArchiveBatch.
+func splitRecipts(recipts []*MessageRecipt) (deleteIds []int64, failed []*MessageRecipt) {
+	deleteIds = make([]int64, 0)
+	failed = make([]*MessageRecipt, 0)
+	for _, r := range recipts {
+		if r.Success {
+			deleteIds = append(deleteIds, r.Id)
+		} else {
+			failed = append(failed, r)
+		}
+	}
+	return deleteIds, failed
+}
+
 // Pgmq ... Structure for holding message
 type Pgmq struct {
 	DB     *sql.DB
 	Prefix string
 	Ttl    time.Duration
-	exit   bool
-	Mutex  *sync.RWMutex
+	// MaxReadCount is how many times a message may fail before it is archived.
+	MaxReadCount int
+	// Dsn is the dedicated connection string ConsumeNotify uses for LISTEN/NOTIFY.
+	Dsn   string
+	exit  bool
+	Mutex *sync.RWMutex
+	// metrics accumulates the counters reported by Collector.
+	metrics metrics
 }
 
 func NewPgmq(db *sql.DB, prefix string) *Pgmq {
-	return &Pgmq{DB: db, Prefix: prefix, Ttl: 0 * time.Millisecond, exit: false, Mutex: &sync.RWMutex{}}
+	return &Pgmq{DB: db, Prefix: prefix, Ttl: 0 * time.Millisecond, MaxReadCount: 5, exit: false, Mutex: &sync.RWMutex{}}
 }
 
-// CreateSchema ... builds any required tables
+// CreateSchema ... builds any required tables, migrating an older deployment forward.
 func (p *Pgmq) CreateSchema() error {
-	s := fmt.Sprintf(createSchema, p.Prefix, p.Prefix, p.Prefix, p.Prefix, p.Prefix)
-	_, err := p.DB.Exec(s)
-	return err
+	return p.Migrate()
 }
 
 // DropSchema ... removes any tables
 func (p *Pgmq) DropSchema() error {
-	s := fmt.Sprintf(dropScrema, p.Prefix, p.Prefix)
+	s := expandPrefix(dropScrema, p.Prefix)
 	_, err := p.DB.Exec(s)
 	return err
 }
@@ -81,108 +114,345 @@ func (p *Pgmq) Exit() bool {
 
 }
 
+// maxPublishBatch caps messages per multi-row INSERT, under PostgreSQL's parameter limit.
+const maxPublishBatch = 1000
+
 // Publish ... This pushes a list of messages into the DB
-func (p *Pgmq) Publish(messages []*Message) error {
+func (p *Pgmq) Publish(ctx context.Context, messages []*Message) error {
 
-	txn, err := p.DB.Begin()
-	defer txn.Commit()
+	txn, err := p.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer txn.Rollback()
 
-	stmt, err := txn.Prepare(pq.CopyIn(fmt.Sprintf("%sq", p.Prefix), "payload"))
-	if err != nil {
+	table := fmt.Sprintf("%sq", p.Prefix)
+	for start := 0; start < len(messages); start += maxPublishBatch {
+		end := start + maxPublishBatch
+		if end > len(messages) {
+			end = len(messages)
+		}
+		if err := publishBatch(ctx, txn, table, messages[start:end]); err != nil {
+			return err
+		}
+	}
+	if err := txn.Commit(); err != nil {
 		return err
 	}
-	for _, m := range messages {
-		_, err := stmt.Exec(m.Payload)
+	atomic.AddUint64(&p.metrics.publishedTotal, uint64(len(messages)))
+	return nil
+}
+
+// publishBatch inserts a single bounded chunk of messages with one multi-row INSERT.
+func publishBatch(ctx context.Context, txn *sql.Tx, table string, messages []*Message) error {
+	const cols = 4
+	values := make([]string, 0, len(messages))
+	args := make([]interface{}, 0, len(messages)*cols)
+	now := time.Now()
+	for i, m := range messages {
+		base := i * cols
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d)", base+1, base+2, base+3, base+4))
+		headers, err := json.Marshal(m.Headers)
 		if err != nil {
 			return err
 		}
+		args = append(args, m.Payload, now.Add(m.Delay), m.Priority, string(headers))
 	}
-	_, err = stmt.Exec()
+	q := fmt.Sprintf("INSERT INTO %s (payload, visible_at, priority, headers) VALUES %s", table, strings.Join(values, ", "))
+	_, err := txn.ExecContext(ctx, q, args...)
 	return err
 }
 
-func (p *Pgmq) Commit(recipts []*MessageRecipt) error {
+// Commit ... Applies the outcome of a consumed batch, deleting successes and handing failures to ArchiveBatch.
+func (p *Pgmq) Commit(ctx context.Context, recipts []*MessageRecipt) error {
 	deleteQuery := fmt.Sprintf("DELETE FROM %sq WHERE id = ANY($1)", p.Prefix)
-	deleteStmt, err := p.DB.Prepare(deleteQuery)
+	deleteStmt, err := p.DB.PrepareContext(ctx, deleteQuery)
 	if err != nil {
 		return err
 	}
 	defer deleteStmt.Close()
-	deleteIds := make([]int64, 0)
+	deleteIds, failed := splitRecipts(recipts)
+	if _, err := deleteStmt.ExecContext(ctx, pq.Array(deleteIds)); err != nil {
+		return err
+	}
+	atomic.AddUint64(&p.metrics.commitSuccessTotal, uint64(len(deleteIds)))
+	atomic.AddUint64(&p.metrics.commitFailedTotal, uint64(len(failed)))
+	return p.ArchiveBatch(ctx, failed)
+}
+
+// Archive ... moves the given message ids from the queue table into the archive table.
+func (p *Pgmq) Archive(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	txn, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	insertQuery := fmt.Sprintf(`INSERT INTO %sq_archive (id, timestamp, checkout, read_ct, payload)
+SELECT id, timestamp, checkout, read_ct, payload FROM %sq WHERE id = ANY($1)`, p.Prefix, p.Prefix)
+	if _, err := txn.ExecContext(ctx, insertQuery, pq.Array(ids)); err != nil {
+		txn.Rollback()
+		return err
+	}
+	deleteQuery := fmt.Sprintf("DELETE FROM %sq WHERE id = ANY($1)", p.Prefix)
+	if _, err := txn.ExecContext(ctx, deleteQuery, pq.Array(ids)); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// ArchiveBatch ... archives failed receipts that exhausted MaxReadCount and resets checkout on the rest.
+func (p *Pgmq) ArchiveBatch(ctx context.Context, recipts []*MessageRecipt) error {
+	ids := make([]int64, 0, len(recipts))
 	for _, r := range recipts {
-		if r.Success {
-			deleteIds = append(deleteIds, r.Id)
+		ids = append(ids, r.Id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	txn, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	archiveQuery := fmt.Sprintf(`INSERT INTO %sq_archive (id, timestamp, checkout, read_ct, payload)
+SELECT id, timestamp, checkout, read_ct, payload FROM %sq WHERE id = ANY($1) AND read_ct >= $2
+RETURNING id`, p.Prefix, p.Prefix)
+	rows, err := txn.QueryContext(ctx, archiveQuery, pq.Array(ids), p.MaxReadCount)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	archivedIds := make([]int64, 0, len(ids))
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			txn.Rollback()
+			return err
 		}
+		archivedIds = append(archivedIds, id)
 	}
-	_, err = deleteStmt.Exec(pq.Array(deleteIds))
+	rows.Close()
+
+	if len(archivedIds) > 0 {
+		deleteQuery := fmt.Sprintf("DELETE FROM %sq WHERE id = ANY($1)", p.Prefix)
+		if _, err := txn.ExecContext(ctx, deleteQuery, pq.Array(archivedIds)); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+
+	retryQuery := fmt.Sprintf("UPDATE %sq SET checkout = NULL WHERE id = ANY($1) AND read_ct < $2", p.Prefix)
+	if _, err := txn.ExecContext(ctx, retryQuery, pq.Array(ids), p.MaxReadCount); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// PurgeArchive ... deletes archived messages older than before, for retention.
+func (p *Pgmq) PurgeArchive(ctx context.Context, before time.Time) error {
+	q := fmt.Sprintf("DELETE FROM %sq_archive WHERE archived_at < $1", p.Prefix)
+	_, err := p.DB.ExecContext(ctx, q, before)
 	return err
 }
 
-// ConsumeBatch ... This consumes a number of messages up to the limit
-func (p *Pgmq) ConsumeBatch(size int) ([]*ConsumerMessage, error) {
+// ConsumeBatch ... consumes up to size messages, picking ids on a snapshot then claiming them with an UPDATE.
+func (p *Pgmq) ConsumeBatch(ctx context.Context, size int) ([]*ConsumerMessage, error) {
 	ms := make([]*ConsumerMessage, 0)
-	// Query any messages that have not been checked out
-	q := fmt.Sprintf("UPDATE %sq SET checkout = now() WHERE id IN (SELECT id FROM %sq WHERE checkout IS null ", p.Prefix, p.Prefix)
-	// If there is a TTL then checkout messages that have expired
-	if p.Ttl.Seconds() > 0.0 {
-		q = fmt.Sprintf("OR checkout + $2 > now()")
+
+	ids, err := p.selectEligible(ctx, size)
+	if err != nil {
+		return ms, err
 	}
-	q = fmt.Sprintf("%s ORDER BY checkout ASC NULLS FIRST, timestamp ASC FOR UPDATE SKIP LOCKED LIMIT $1) RETURNING id, payload;", q)
-	txn, err := p.DB.Begin()
+	if len(ids) == 0 {
+		return ms, nil
+	}
+
+	txn, err := p.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return ms, err
 	}
-	defer txn.Commit()
 
-	stmt, err := p.DB.Prepare(q)
+	q := claimQuery(p.Prefix, p.Ttl)
+	stmt, err := txn.PrepareContext(ctx, q)
 	if err != nil {
+		txn.Rollback()
 		return ms, err
 	}
 	defer stmt.Close()
 
 	var rows *sql.Rows
-
-	// TTL queries takes an extra param
+	// TTL queries take an extra param, same as selectEligible
 	if p.Ttl.Seconds() > 0.0 {
-		rows, err = stmt.Query(size, p.Ttl)
+		rows, err = stmt.QueryContext(ctx, pq.Array(ids), p.Ttl)
 	} else {
-		rows, err = stmt.Query(size)
+		rows, err = stmt.QueryContext(ctx, pq.Array(ids))
 	}
 	if err != nil {
+		txn.Rollback()
 		return ms, err
 	}
-
-	defer rows.Close()
 	for rows.Next() {
 		var id int64
 		var payload []byte
-		rows.Scan(&id, &payload)
-		ms = append(ms, &ConsumerMessage{Message: Message{Payload: payload}, Id: id})
+		var priority int16
+		var headersRaw []byte
+		if err := rows.Scan(&id, &payload, &priority, &headersRaw); err != nil {
+			rows.Close()
+			txn.Rollback()
+			return ms, err
+		}
+		var headers map[string]string
+		if len(headersRaw) > 0 {
+			json.Unmarshal(headersRaw, &headers)
+		}
+		ms = append(ms, &ConsumerMessage{Message: Message{Payload: payload, Priority: priority, Headers: headers}, Id: id})
+	}
+	rows.Close()
+
+	if err := txn.Commit(); err != nil {
+		return ms, err
 	}
+
+	atomic.AddUint64(&p.metrics.consumedTotal, uint64(len(ms)))
 	return ms, nil
 }
 
-// Consumer ... Creates a stream of consumption
-func (p *Pgmq) Consume(size int, messages chan []*ConsumerMessage, pause time.Duration) {
+// notCheckedOutClause is the reclaimable-row predicate shared by eligibleQuery and claimQuery.
+func notCheckedOutClause(ttl time.Duration) string {
+	if ttl.Seconds() > 0.0 {
+		return "(checkout IS null OR checkout + $2 < now())"
+	}
+	return "checkout IS null"
+}
+
+// eligibleQuery builds the candidate-id SELECT for selectEligible.
+func eligibleQuery(prefix string, ttl time.Duration) string {
+	return fmt.Sprintf("SELECT id FROM %sq WHERE %s AND visible_at <= now() ORDER BY priority DESC, visible_at ASC, timestamp ASC LIMIT $1", prefix, notCheckedOutClause(ttl))
+}
+
+// claimQuery builds the claiming UPDATE for ConsumeBatch.
+func claimQuery(prefix string, ttl time.Duration) string {
+	return fmt.Sprintf("UPDATE %sq SET checkout = now(), read_ct = read_ct + 1 WHERE id = ANY($1) AND %s RETURNING id, payload, priority, headers", prefix, notCheckedOutClause(ttl))
+}
+
+// selectEligible picks up to size candidate ids on a read-only snapshot.
+func (p *Pgmq) selectEligible(ctx context.Context, size int) ([]int64, error) {
+	txn, err := p.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	q := eligibleQuery(p.Prefix, p.Ttl)
+
+	stmt, err := txn.PrepareContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var rows *sql.Rows
+	// TTL queries takes an extra param
+	if p.Ttl.Seconds() > 0.0 {
+		rows, err = stmt.QueryContext(ctx, size, p.Ttl)
+	} else {
+		rows, err = stmt.QueryContext(ctx, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, size)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Consumer ... Creates a stream of consumption. The loop exits as soon as
+// ctx is cancelled.
+func (p *Pgmq) Consume(ctx context.Context, size int, messages chan []*ConsumerMessage, pause time.Duration) {
 	for {
+		if ctx.Err() != nil {
+			return
+		}
 
 		// Consume until there are no more messages or there is an error
 		// No messages there was an error or time to exit
 		for {
-			ms, err := p.ConsumeBatch(size)
+			ms, err := p.ConsumeBatch(ctx, size)
 			// If exit then
-			if p.Exit() {
+			if p.Exit() || ctx.Err() != nil {
 				return
 			}
 			if len(ms) == 0 || err != nil {
 				break
 			}
-			messages <- ms
+			select {
+			case messages <- ms:
+			case <-ctx.Done():
+				return
+			}
 		}
 		// Breather so not just infinate loop of queries
-		time.Sleep(pause)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pause):
+		}
+	}
+}
+
+// notifyFallbackInterval bounds how long ConsumeNotify waits for a pg_notify before polling anyway.
+const notifyFallbackInterval = 5 * time.Second
+
+// ConsumeNotify ... Creates a stream of consumption driven by LISTEN/NOTIFY, falling back to a ticker.
+func (p *Pgmq) ConsumeNotify(ctx context.Context, size int, messages chan []*ConsumerMessage) error {
+	channel := fmt.Sprintf("%sq_new", p.Prefix)
+	listener := pq.NewListener(p.Dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {})
+	defer listener.Close()
+	if err := listener.Listen(channel); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(notifyFallbackInterval)
+	defer ticker.Stop()
+
+	for {
+		if p.Exit() || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-listener.Notify:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		for {
+			ms, err := p.ConsumeBatch(ctx, size)
+			if err != nil {
+				return err
+			}
+			if p.Exit() {
+				return nil
+			}
+			if len(ms) == 0 {
+				break
+			}
+			messages <- ms
+		}
 	}
 }
@@ -0,0 +1,80 @@
+package mq
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitRecipts(t *testing.T) {
+	recipts := []*MessageRecipt{
+		{Id: 1, Success: true},
+		{Id: 2, Success: false},
+		{Id: 3, Success: true},
+	}
+
+	deleteIds, failed := splitRecipts(recipts)
+
+	if !reflect.DeepEqual(deleteIds, []int64{1, 3}) {
+		t.Errorf("deleteIds = %v, want [1 3]", deleteIds)
+	}
+	if len(failed) != 1 || failed[0].Id != 2 {
+		t.Errorf("failed = %v, want [{2 false}]", failed)
+	}
+}
+
+func TestEligibleQueryHonorsTtl(t *testing.T) {
+	withoutTtl := eligibleQuery("test_", 0)
+	if strings.Contains(withoutTtl, "checkout +") {
+		t.Errorf("query without a Ttl should not reclaim checkouts: %s", withoutTtl)
+	}
+
+	withTtl := eligibleQuery("test_", 30*time.Second)
+	if !strings.Contains(withTtl, "checkout + $2 < now()") {
+		t.Errorf("query with a Ttl should reclaim checkouts older than Ttl, got: %s", withTtl)
+	}
+	if strings.Contains(withTtl, "checkout + $2 > now()") {
+		t.Errorf("expired-checkout comparison points the wrong way: %s", withTtl)
+	}
+}
+
+func TestClaimQueryMatchesEligibleQuery(t *testing.T) {
+	for _, ttl := range []time.Duration{0, 30 * time.Second} {
+		claim := claimQuery("test_", ttl)
+		if !strings.Contains(claim, notCheckedOutClause(ttl)) {
+			t.Errorf("claimQuery(ttl=%v) = %q, want it to contain %q so selectEligible's ids are always claimable", ttl, claim, notCheckedOutClause(ttl))
+		}
+	}
+
+	withTtl := claimQuery("test_", 30*time.Second)
+	if strings.Contains(withTtl, "AND checkout IS null RETURNING") {
+		t.Errorf("claiming UPDATE with a Ttl must not require a bare checkout IS null, it would never reclaim expired checkouts: %s", withTtl)
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	all := make([]int, len(migrations))
+	for i := range migrations {
+		all[i] = i
+	}
+
+	cases := []struct {
+		version int
+		want    []int
+	}{
+		{version: -1, want: all},
+		{version: 1, want: all[2:]},
+		{version: len(migrations) - 1, want: []int{}},
+	}
+
+	for _, c := range cases {
+		got := pendingMigrations(c.version)
+		if len(got) == 0 && len(c.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("pendingMigrations(%d) = %v, want %v", c.version, got, c.want)
+		}
+	}
+}